@@ -1,40 +1,56 @@
 package manifest
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+
+	buildcontext "github.com/reverbdotcom/rack/manifest/context"
+	"github.com/reverbdotcom/rack/manifest/dockerfile"
 )
 
 type BuildOptions struct {
 	Cache       bool
 	CacheDir    string
+	Concurrency int
 	Environment map[string]string
+	Events      chan Event
 	Service     string
 	Verbose     bool
 }
 
+// Build builds or pulls every service needed to run the manifest,
+// respecting dependencies introduced by `links` between built services: a
+// built service only starts once every built service it links to has
+// finished. Links to `image:` services are not waited on, and pulls start
+// without waiting on any links. Independent services run
+// concurrently, up to opts.Concurrency at a time (runtime.NumCPU() by
+// default). Services whose Build.Hash() matches one already building
+// share that single build and are tagged from its result instead of
+// building again.
 func (m *Manifest) Build(dir, appName string, s Stream, opts BuildOptions) error {
-	pulls := map[string][]string{}
-	builds := []Service{}
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = runtime.NumCPU()
+	}
 
 	services, err := m.runOrder(opts.Service)
 	if err != nil {
 		return err
 	}
 
+	pulls := map[string][]string{}
+	builds := []Service{}
+
 	for _, service := range services {
-		dockerFile := service.Build.Dockerfile
-		if dockerFile == "" {
-			dockerFile = service.Dockerfile
-		}
 		if image := service.Image; image != "" {
 			// make the implicit :latest explicit for caching/pulling
 			sp := strings.Split(image, "/")
@@ -47,137 +63,288 @@ func (m *Manifest) Build(dir, appName string, s Stream, opts BuildOptions) error
 		}
 	}
 
-	buildCache := map[string]string{}
-
+	// jobs are all created up front so that goroutines only ever read the
+	// maps concurrently; only the jobs themselves are mutated once work
+	// starts.
+	buildJobs := map[string]*buildJob{}
 	for _, service := range builds {
-		if bc, ok := buildCache[service.Build.Hash()]; ok {
-			if err := DefaultRunner.Run(s, Docker("tag", bc, service.Tag(appName)), RunnerOptions{Verbose: opts.Verbose}); err != nil {
-				return fmt.Errorf("build error: %s", err)
-			}
-			continue
-		}
+		buildJobs[service.Name] = newBuildJob(service)
+	}
 
-		args := []string{"build"}
+	pullJobs := map[string]*buildJob{}
+	for image := range pulls {
+		pullJobs[image] = newBuildJob(Service{Name: image})
+	}
 
-		if !opts.Cache {
-			args = append(args, "--no-cache")
-		}
+	bc := newBuildCache()
+	cleanups := &cleanupList{}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
 
-		context := filepath.Join(dir, coalesce(service.Build.Context, "."))
-		dockerFile := coalesce(service.Dockerfile, "Dockerfile")
-		dockerFile = coalesce(service.Build.Dockerfile, dockerFile)
-		dockerFile = filepath.Join(context, dockerFile)
+	for _, service := range builds {
+		wg.Add(1)
 
-		if opts.CacheDir != "" {
-			rcd := filepath.Join(opts.CacheDir, service.Build.Hash())
-			lcd := filepath.Join(dir, ".cache", "build")
+		go func(service Service) {
+			defer wg.Done()
 
-			_, err := os.Stat(rcd)
-			if os.IsNotExist(err) {
-				// remote cache doesn't exist, do nothing
-			} else if err == nil {
-				if err := os.RemoveAll(lcd); err != nil {
-					s <- fmt.Sprintf("cache error: %s", err)
+			job := buildJobs[service.Name]
+
+			for _, link := range service.Links {
+				dep, ok := buildJobs[link]
+				if !ok {
+					continue
 				}
 
-				if err := copyDir(rcd, lcd); err != nil {
-					// do not display "error" if dir doesn't exist
-					if !strings.Contains(err.Error(), "no such file or directory") {
-						s <- fmt.Sprintf("cache error: %s", err)
-					}
+				if err := dep.wait(); err != nil {
+					job.finish(fmt.Errorf("build error: dependency %s failed: %s", link, err))
+					return
 				}
 			}
-		}
 
-		bargs := map[string]string{}
+			sem <- struct{}{}
+			defer func() { <-sem }()
 
-		for k, v := range service.Build.Args {
-			bargs[k] = v
-		}
+			job.finish(m.buildOne(dir, appName, s, opts, service, bc, cleanups))
+		}(service)
+	}
 
-		dba, err := buildArgs(dockerFile)
-		if err != nil {
+	for image, tags := range pulls {
+		wg.Add(1)
+
+		go func(image string, tags []string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			pullJobs[image].finish(m.pullOne(s, opts, image, tags))
+		}(image, tags)
+	}
+
+	wg.Wait()
+	cleanups.run()
+
+	for _, service := range builds {
+		if err := buildJobs[service.Name].wait(); err != nil {
 			return err
 		}
+	}
 
-		for _, ba := range dba {
-			if v, ok := opts.Environment[ba]; ok {
-				bargs[ba] = v
-			}
+	for image := range pulls {
+		if err := pullJobs[image].wait(); err != nil {
+			return err
 		}
+	}
 
-		bargNames := []string{}
+	return nil
+}
+
+// buildOne builds a single service, or — if another service in this Build
+// with an identical Build.Hash() got there first — tags its image instead.
+func (m *Manifest) buildOne(dir, appName string, s Stream, opts BuildOptions, service Service, bc *buildCache, cleanups *cleanupList) error {
+	ss := serviceStream(s, opts.Events, service.Name)
+	defer close(ss)
 
-		for k := range bargs {
-			bargNames = append(bargNames, k)
+	winner, err := bc.build(service.Build.Hash(), func() (string, error) {
+		if err := m.dockerBuild(dir, appName, ss, opts, service, cleanups); err != nil {
+			return "", err
 		}
 
-		sort.Strings(bargNames)
+		return service.Tag(appName), nil
+	})
+	if err != nil {
+		return fmt.Errorf("build error: %s", err)
+	}
+
+	if winner == service.Tag(appName) {
+		return nil
+	}
+
+	if err := DefaultRunner.Run(ss, Docker("tag", winner, service.Tag(appName)), RunnerOptions{Verbose: opts.Verbose}); err != nil {
+		return fmt.Errorf("build error: %s", err)
+	}
+
+	emitEvent(opts.Events, Event{Service: service.Name, Kind: EventTag, Status: fmt.Sprintf("tagged from %s", winner)})
+
+	return nil
+}
+
+// dockerBuild runs the actual `docker build` for service, including
+// ONBUILD trigger recording and remote build cache handling.
+func (m *Manifest) dockerBuild(dir, appName string, s Stream, opts BuildOptions, service Service, cleanups *cleanupList) error {
+	args := []string{"build"}
 
-		for _, name := range bargNames {
-			args = append(args, "--build-arg", fmt.Sprintf("%s=%s", name, bargs[name]))
+	if !opts.Cache {
+		args = append(args, "--no-cache")
+	}
+
+	var context string
+
+	if buildcontext.IsRemote(service.Build.Context) {
+		local, cleanup, err := buildcontext.Resolve(service.Build.Context)
+		if err != nil {
+			return fmt.Errorf("build error: %s", err)
 		}
 
-		args = append(args, "-f", dockerFile)
-		args = append(args, "-t", service.Tag(appName))
-		args = append(args, context)
-
-		ropts := RunnerOptions{
-			Verbose: opts.Verbose,
-			StreamHandlers: []RunnerStreamHandler{
-				func(str string) string {
-					// do not display "error" if dir doesn't exist
-					if strings.Contains(str, "/var/cache/build: no such file or directory") {
-						return ""
-					}
-					return str
-				},
-			},
+		cleanups.add(cleanup)
+		context = local
+	} else {
+		context = filepath.Join(dir, coalesce(service.Build.Context, "."))
+	}
+
+	dockerFile := coalesce(service.Dockerfile, "Dockerfile")
+	dockerFile = coalesce(service.Build.Dockerfile, dockerFile)
+	dockerFile = filepath.Join(context, dockerFile)
+
+	bargs := map[string]string{}
+
+	for k, v := range service.Build.Args {
+		bargs[k] = v
+	}
+
+	dba, err := buildArgs(dockerFile)
+	if err != nil {
+		return err
+	}
+
+	for _, ba := range dba {
+		if v, ok := opts.Environment[ba]; ok {
+			bargs[ba] = v
 		}
+	}
 
-		if err := DefaultRunner.Run(s, Docker(args...), ropts); err != nil {
-			return fmt.Errorf("build error: %s", err)
+	df, err := dockerfile.ParseFile(dockerFile)
+	if err != nil {
+		return err
+	}
+
+	if stage := df.Target(); stage != nil {
+		if own := stage.OnBuild(); len(own) > 0 {
+			raws := make([]string, len(own))
+			for i, t := range own {
+				raws[i] = t.Raw
+			}
+
+			label, err := json.Marshal(raws)
+			if err != nil {
+				return err
+			}
+
+			args = append(args, "--label", fmt.Sprintf("%s=%s", onBuildLabel, label))
 		}
 
-		if opts.CacheDir != "" {
-			hash := service.Build.Hash()
+		if df.Stage(stage.From) == nil {
+			triggers, err := baseImageOnBuild(s, stage.From, opts.Verbose)
+			if err != nil {
+				return fmt.Errorf("build error: %s", err)
+			}
 
-			if err := DefaultRunner.Run(s, Docker("create", "--name", hash, service.Tag(appName)), ropts); err != nil {
-				s <- fmt.Sprintf("cache error: %s", err)
+			// Docker already runs these triggers itself as part of `docker
+			// build`; we only surface them here so they show up in the
+			// build log. Re-inlining them into the Dockerfile we pass to
+			// `docker build` would make every trigger run a second time.
+			for _, t := range triggers {
+				s <- fmt.Sprintf("inherited onbuild: %s", t.Raw)
 			}
+		}
+	}
 
-			exec.Command("rm", "-rf", filepath.Join(opts.CacheDir, hash)).Run()
+	remoteContext := buildcontext.IsRemote(service.Build.Context)
 
-			if err := DefaultRunner.Run(s, Docker("cp", fmt.Sprintf("%s:/var/cache/build", hash), filepath.Join(opts.CacheDir, hash)), ropts); err != nil {
-				s <- fmt.Sprintf("ignoring build cache")
+	if opts.CacheDir != "" && !remoteContext {
+		chash, err := service.Build.ContextHash(dir, dockerFile, bargs)
+		if err != nil {
+			return fmt.Errorf("build error: %s", err)
+		}
+
+		if id, ok := remoteCacheHit(opts.CacheDir, chash); ok {
+			if err := DefaultRunner.Run(s, Docker("tag", id, service.Tag(appName)), RunnerOptions{Verbose: opts.Verbose}); err != nil {
+				return fmt.Errorf("build error: %s", err)
 			}
 
-			if err := DefaultRunner.Run(s, Docker("rm", hash), ropts); err != nil {
+			s <- fmt.Sprintf("cache hit: %s", chash)
+
+			emitEvent(opts.Events, Event{Service: service.Name, Kind: EventCache, Status: "hit", ID: chash})
+
+			return nil
+		}
+
+		rcd := filepath.Join(opts.CacheDir, service.Build.Hash())
+		lcd := filepath.Join(dir, ".cache", "build")
+
+		_, err = os.Stat(rcd)
+		if os.IsNotExist(err) {
+			// remote cache doesn't exist, do nothing
+		} else if err == nil {
+			if err := os.RemoveAll(lcd); err != nil {
 				s <- fmt.Sprintf("cache error: %s", err)
 			}
+
+			if err := copyDir(rcd, lcd); err != nil {
+				// do not display "error" if dir doesn't exist
+				if !strings.Contains(err.Error(), "no such file or directory") {
+					s <- fmt.Sprintf("cache error: %s", err)
+				}
+			}
 		}
+	}
+
+	bargNames := []string{}
 
-		buildCache[service.Build.Hash()] = service.Tag(appName)
+	for k := range bargs {
+		bargNames = append(bargNames, k)
 	}
 
-	for image, tags := range pulls {
-		args := []string{"pull"}
+	sort.Strings(bargNames)
 
-		output, err := DefaultRunner.CombinedOutput(Docker("images", "-q", image))
-		if err != nil {
-			return err
+	for _, name := range bargNames {
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", name, bargs[name]))
+	}
+
+	args = append(args, "-f", dockerFile)
+	args = append(args, "-t", service.Tag(appName))
+	args = append(args, context)
+
+	ropts := RunnerOptions{
+		Verbose: opts.Verbose,
+		StreamHandlers: []RunnerStreamHandler{
+			func(str string) string {
+				// do not display "error" if dir doesn't exist
+				if strings.Contains(str, "/var/cache/build: no such file or directory") {
+					return ""
+				}
+				return str
+			},
+		},
+	}
+
+	if err := DefaultRunner.Run(s, Docker(args...), ropts); err != nil {
+		return fmt.Errorf("build error: %s", err)
+	}
+
+	if opts.CacheDir != "" {
+		hash := service.Build.Hash()
+
+		if err := DefaultRunner.Run(s, Docker("create", "--name", hash, service.Tag(appName)), ropts); err != nil {
+			s <- fmt.Sprintf("cache error: %s", err)
 		}
 
-		args = append(args, image)
+		exec.Command("rm", "-rf", filepath.Join(opts.CacheDir, hash)).Run()
 
-		if !opts.Cache || len(output) == 0 {
-			if err := DefaultRunner.Run(s, Docker("pull", image), RunnerOptions{Verbose: opts.Verbose}); err != nil {
-				return fmt.Errorf("build error: %s", err)
-			}
+		if err := DefaultRunner.Run(s, Docker("cp", fmt.Sprintf("%s:/var/cache/build", hash), filepath.Join(opts.CacheDir, hash)), ropts); err != nil {
+			s <- fmt.Sprintf("ignoring build cache")
 		}
-		for _, tag := range tags {
-			if err := DefaultRunner.Run(s, Docker("tag", image, tag), RunnerOptions{Verbose: opts.Verbose}); err != nil {
-				return fmt.Errorf("build error: %s", err)
+
+		if err := DefaultRunner.Run(s, Docker("rm", hash), ropts); err != nil {
+			s <- fmt.Sprintf("cache error: %s", err)
+		}
+
+		if !remoteContext {
+			if chash, err := service.Build.ContextHash(dir, dockerFile, bargs); err != nil {
+				s <- fmt.Sprintf("cache error: %s", err)
+			} else if err := writeRemoteCacheMarker(opts.CacheDir, chash, service.Tag(appName)); err != nil {
+				s <- fmt.Sprintf("cache error: %s", err)
 			}
 		}
 	}
@@ -185,27 +352,49 @@ func (m *Manifest) Build(dir, appName string, s Stream, opts BuildOptions) error
 	return nil
 }
 
-func buildArgs(dockerfile string) ([]string, error) {
-	args := []string{}
+// pullOne pulls image (unless already present and opts.Cache is set) and
+// tags it for every service configured to use it directly.
+func (m *Manifest) pullOne(s Stream, opts BuildOptions, image string, tags []string) error {
+	ss := serviceStream(s, opts.Events, image)
+	defer close(ss)
 
-	data, err := ioutil.ReadFile(dockerfile)
+	output, err := DefaultRunner.CombinedOutput(Docker("images", "-q", image))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-
-	for scanner.Scan() {
-		parts := strings.Fields(scanner.Text())
-
-		if len(parts) < 1 {
-			continue
+	if !opts.Cache || len(output) == 0 {
+		if err := DefaultRunner.Run(ss, Docker("pull", image), RunnerOptions{Verbose: opts.Verbose}); err != nil {
+			return fmt.Errorf("build error: %s", err)
 		}
+	}
 
-		switch parts[0] {
-		case "ARG":
-			args = append(args, strings.SplitN(parts[1], "=", 2)[0])
+	for _, tag := range tags {
+		if err := DefaultRunner.Run(ss, Docker("tag", image, tag), RunnerOptions{Verbose: opts.Verbose}); err != nil {
+			return fmt.Errorf("build error: %s", err)
 		}
+
+		emitEvent(opts.Events, Event{Service: image, Kind: EventTag, Status: fmt.Sprintf("tag %s", tag), ID: tag})
+	}
+
+	return nil
+}
+
+// buildArgs returns the names of the ARGs that are actually in scope for
+// the image a plain `docker build` of dockerfilePath would produce: those
+// declared on the target stage and every stage it descends from. Values
+// from opts.Environment are only passed as --build-arg for these names;
+// service.Build.Args are passed as given, whether declared or not.
+func buildArgs(dockerfilePath string) ([]string, error) {
+	df, err := dockerfile.ParseFile(dockerfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+
+	for _, a := range df.TargetArgs() {
+		args = append(args, a.Name)
 	}
 
 	return args, nil
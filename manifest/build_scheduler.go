@@ -0,0 +1,113 @@
+package manifest
+
+import (
+	"fmt"
+	"sync"
+)
+
+// buildJob tracks one build service's completion so that services
+// depending on it (via `links`) can block until it either succeeds or
+// fails, without re-running it themselves.
+type buildJob struct {
+	service Service
+	done    chan struct{}
+	err     error
+}
+
+func newBuildJob(service Service) *buildJob {
+	return &buildJob{service: service, done: make(chan struct{})}
+}
+
+func (j *buildJob) finish(err error) {
+	j.err = err
+	close(j.done)
+}
+
+// wait blocks until the job has finished and returns its error, if any.
+// It is safe to call from multiple goroutines.
+func (j *buildJob) wait() error {
+	<-j.done
+	return j.err
+}
+
+// buildCache lets concurrent services that resolve to the same
+// Build.Hash() share a single underlying `docker build`: the first caller
+// for a given hash runs fn, and every other caller blocks until it
+// finishes, then reuses its tag.
+type buildCache struct {
+	mu      sync.Mutex
+	entries map[string]*buildCacheEntry
+}
+
+type buildCacheEntry struct {
+	once sync.Once
+	tag  string
+	err  error
+}
+
+func newBuildCache() *buildCache {
+	return &buildCache{entries: map[string]*buildCacheEntry{}}
+}
+
+// build returns the tag that resulted from building hash, invoking fn to
+// produce it the first time hash is seen and reusing that result for
+// every later call with the same hash.
+func (c *buildCache) build(hash string, fn func() (string, error)) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[hash]
+	if !ok {
+		entry = &buildCacheEntry{}
+		c.entries[hash] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.tag, entry.err = fn()
+	})
+
+	return entry.tag, entry.err
+}
+
+// cleanupList collects cleanup funcs from concurrent goroutines (e.g. the
+// local checkouts made by buildcontext.Resolve for remote contexts) to run
+// once the whole Build has finished.
+type cleanupList struct {
+	mu    sync.Mutex
+	funcs []func()
+}
+
+func (c *cleanupList) add(fn func()) {
+	c.mu.Lock()
+	c.funcs = append(c.funcs, fn)
+	c.mu.Unlock()
+}
+
+func (c *cleanupList) run() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, fn := range c.funcs {
+		fn()
+	}
+}
+
+// serviceStream decorates s so that every line written to the returned
+// Stream is prefixed with "<name> | ", the way parallel build/pull output
+// is interleaved, and — if events is non-nil — classified into an Event
+// and forwarded there too. The caller must close the returned Stream once
+// it is done writing to let the forwarding goroutine exit.
+func serviceStream(s Stream, events chan Event, name string) Stream {
+	out := make(Stream)
+
+	go func() {
+		for line := range out {
+			if e := parseEvent(name, line); e != nil {
+				emitEvent(events, *e)
+			}
+
+			s <- fmt.Sprintf("%s | %s", name, line)
+		}
+	}()
+
+	return out
+}
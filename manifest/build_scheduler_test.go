@@ -0,0 +1,116 @@
+package manifest
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBuildJobOrdering exercises the same wait/finish handshake Build uses
+// to make a service block until everything it links to has finished: a
+// dependent job must never proceed past its dependency's wait() until that
+// dependency has called finish().
+func TestBuildJobOrdering(t *testing.T) {
+	dep := newBuildJob(Service{Name: "dep"})
+	dependent := newBuildJob(Service{Name: "dependent"})
+
+	var depFinishedFirst int32
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		dep.finish(nil)
+	}()
+
+	go func() {
+		if err := dep.wait(); err != nil {
+			dependent.finish(err)
+			return
+		}
+
+		atomic.StoreInt32(&depFinishedFirst, 1)
+		dependent.finish(nil)
+	}()
+
+	if err := dependent.wait(); err != nil {
+		t.Fatalf("dependent job failed: %s", err)
+	}
+
+	if atomic.LoadInt32(&depFinishedFirst) != 1 {
+		t.Fatal("dependent job finished before its dependency did")
+	}
+}
+
+// TestBuildCacheDedupesConcurrentBuilds covers the sharing behavior
+// buildOne relies on: services whose Build.Hash() collides must only
+// invoke the underlying build once, however many of them race in at once.
+func TestBuildCacheDedupesConcurrentBuilds(t *testing.T) {
+	bc := newBuildCache()
+
+	var calls int32
+	var wg sync.WaitGroup
+
+	results := make([]string, 10)
+	errs := make([]error, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			tag, err := bc.build("samehash", func() (string, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(10 * time.Millisecond)
+				return "image:samehash", nil
+			})
+
+			results[i] = tag
+			errs[i] = err
+		}(i)
+	}
+
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected exactly one build for a shared hash, got %d", calls)
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: unexpected error: %s", i, err)
+		}
+		if results[i] != "image:samehash" {
+			t.Fatalf("caller %d: got tag %q, want %q", i, results[i], "image:samehash")
+		}
+	}
+}
+
+// TestBuildCacheDifferentHashesBuildIndependently guards against an overly
+// broad cache key: distinct Build.Hash() values must each build exactly
+// once, independently of one another.
+func TestBuildCacheDifferentHashesBuildIndependently(t *testing.T) {
+	bc := newBuildCache()
+
+	var calls int32
+	var wg sync.WaitGroup
+
+	hashes := []string{"a", "b", "c"}
+
+	for _, h := range hashes {
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+
+			bc.build(h, func() (string, error) {
+				atomic.AddInt32(&calls, 1)
+				return "image:" + h, nil
+			})
+		}(h)
+	}
+
+	wg.Wait()
+
+	if calls != int32(len(hashes)) {
+		t.Fatalf("expected %d builds for %d distinct hashes, got %d", len(hashes), len(hashes), calls)
+	}
+}
@@ -0,0 +1,201 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner is a Runner that never shells out to a real docker binary: it
+// records every command's argv, in the order Run/CombinedOutput were
+// called, so tests can assert on scheduling behavior without a docker
+// daemon. `docker inspect` calls are answered with just enough canned
+// output to let dockerBuild's ONBUILD/cache lookups proceed.
+type fakeRunner struct {
+	mu       sync.Mutex
+	commands [][]string
+}
+
+func (f *fakeRunner) record(cmd *exec.Cmd) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, append([]string{}, cmd.Args...))
+}
+
+func (f *fakeRunner) Run(s Stream, cmd *exec.Cmd, opts RunnerOptions) error {
+	f.record(cmd)
+	return nil
+}
+
+func (f *fakeRunner) CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	f.record(cmd)
+
+	if len(cmd.Args) >= 2 && cmd.Args[1] == "inspect" {
+		for _, a := range cmd.Args {
+			if strings.Contains(a, "OnBuild") {
+				return []byte("[]"), nil
+			}
+		}
+		return []byte("sha256:fake"), nil
+	}
+
+	return []byte(""), nil
+}
+
+// calls returns every recorded command whose docker subcommand (argv[1])
+// is sub, in call order.
+func (f *fakeRunner) calls(sub string) [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := [][]string{}
+	for _, c := range f.commands {
+		if len(c) >= 2 && c[1] == sub {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func withFakeRunner(t *testing.T) *fakeRunner {
+	t.Helper()
+
+	orig := DefaultRunner
+	fr := &fakeRunner{}
+	DefaultRunner = fr
+	t.Cleanup(func() { DefaultRunner = orig })
+
+	return fr
+}
+
+func writeDockerfile(t *testing.T, dir string) {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tagArg(cmd []string) string {
+	for i, a := range cmd {
+		if a == "-t" && i+1 < len(cmd) {
+			return cmd[i+1]
+		}
+	}
+	return ""
+}
+
+// TestManifestBuildRespectsLinkOrdering exercises Manifest.Build end to
+// end through a fake Runner: "api" links to "web", so its `docker build`
+// must only run after web's has completed, even though the two could
+// otherwise run concurrently.
+func TestManifestBuildRespectsLinkOrdering(t *testing.T) {
+	dir := t.TempDir()
+	writeDockerfile(t, filepath.Join(dir, "web"))
+	writeDockerfile(t, filepath.Join(dir, "api"))
+
+	fr := withFakeRunner(t)
+
+	m := &Manifest{
+		Services: []Service{
+			{Name: "web", Build: Build{Context: "web"}},
+			{Name: "api", Build: Build{Context: "api"}, Links: []string{"web"}},
+		},
+	}
+
+	s := make(Stream, 100)
+
+	if err := m.Build(dir, "app", s, BuildOptions{Concurrency: 2}); err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+
+	builds := fr.calls("build")
+	if len(builds) != 2 {
+		t.Fatalf("expected 2 docker build invocations, got %d: %v", len(builds), builds)
+	}
+
+	webIdx, apiIdx := -1, -1
+	for i, c := range builds {
+		switch {
+		case strings.Contains(tagArg(c), "web"):
+			webIdx = i
+		case strings.Contains(tagArg(c), "api"):
+			apiIdx = i
+		}
+	}
+
+	if webIdx < 0 || apiIdx < 0 {
+		t.Fatalf("could not find both builds by tag: %v", builds)
+	}
+	if apiIdx < webIdx {
+		t.Fatal("api built before the web service it links to had finished")
+	}
+}
+
+// TestManifestBuildDedupesSharedHash exercises Manifest.Build for two
+// services with an identical Build (and therefore an identical
+// Build.Hash()): only one should actually run `docker build`, and the
+// second should be `docker tag`-ed from its result instead of building a
+// second time.
+func TestManifestBuildDedupesSharedHash(t *testing.T) {
+	dir := t.TempDir()
+	writeDockerfile(t, dir)
+
+	fr := withFakeRunner(t)
+
+	m := &Manifest{
+		Services: []Service{
+			{Name: "a", Build: Build{Context: "."}},
+			{Name: "b", Build: Build{Context: "."}},
+		},
+	}
+
+	s := make(Stream, 100)
+
+	if err := m.Build(dir, "app", s, BuildOptions{Concurrency: 2}); err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+
+	if builds := fr.calls("build"); len(builds) != 1 {
+		t.Fatalf("expected exactly 1 docker build for two services with an identical Build, got %d: %v", len(builds), builds)
+	}
+
+	if tags := fr.calls("tag"); len(tags) != 1 {
+		t.Fatalf("expected exactly 1 docker tag to clone the shared build, got %d: %v", len(tags), tags)
+	}
+}
+
+// TestManifestBuildPullsImageServicesWithoutBuilding covers the other half
+// of the scheduler: a service configured with `image:` is pulled and
+// tagged, never built.
+func TestManifestBuildPullsImageServicesWithoutBuilding(t *testing.T) {
+	dir := t.TempDir()
+
+	fr := withFakeRunner(t)
+
+	m := &Manifest{
+		Services: []Service{
+			{Name: "cache", Image: "redis"},
+		},
+	}
+
+	s := make(Stream, 100)
+
+	if err := m.Build(dir, "app", s, BuildOptions{Concurrency: 2}); err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+
+	if builds := fr.calls("build"); len(builds) != 0 {
+		t.Fatalf("expected no docker build for an image-only service, got %v", builds)
+	}
+	if pulls := fr.calls("pull"); len(pulls) != 1 {
+		t.Fatalf("expected exactly 1 docker pull, got %d: %v", len(pulls), pulls)
+	}
+}
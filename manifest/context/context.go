@@ -0,0 +1,145 @@
+// Package context resolves a build context reference that isn't a plain
+// local path — a git ref, a URL to a tarball, or a tar stream on stdin —
+// into a local directory, the way `docker build` itself accepts a git
+// URL, a tarball URL, or `-` as its context argument.
+package context
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// IsRemote reports whether ref is one of the remote context forms this
+// package knows how to resolve, rather than a plain local path.
+func IsRemote(ref string) bool {
+	switch {
+	case ref == "-":
+		return true
+	case strings.HasPrefix(ref, "git://"), strings.HasPrefix(ref, "git@"):
+		return true
+	case strings.HasPrefix(ref, "http://"), strings.HasPrefix(ref, "https://"):
+		return isTarballURL(ref)
+	default:
+		return false
+	}
+}
+
+func isTarballURL(ref string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(ref, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve materializes ref into a local directory and returns it along
+// with a cleanup function the caller should run once it is done building
+// from that directory.
+func Resolve(ref string) (string, func(), error) {
+	switch {
+	case ref == "-":
+		return resolveTar(os.Stdin)
+	case strings.HasPrefix(ref, "git://"), strings.HasPrefix(ref, "git@"):
+		return resolveGit(ref)
+	case strings.HasPrefix(ref, "http://"), strings.HasPrefix(ref, "https://"):
+		return resolveTarballURL(ref)
+	default:
+		return "", nil, fmt.Errorf("not a remote build context: %s", ref)
+	}
+}
+
+// resolveGit resolves a "git://host/repo.git#ref:subdir" (the "#ref" and
+// ":subdir" both optional) reference by archiving ref directly from the
+// remote with `git archive` and extracting it into a temp directory.
+func resolveGit(ref string) (string, func(), error) {
+	uri, gitRef, subdir := splitGitRef(ref)
+
+	dir, err := ioutil.TempDir("", "convox-context-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	cleanup := func() { os.RemoveAll(dir) }
+
+	archive := exec.Command("git", "archive", "--remote="+uri, gitRef)
+	untar := exec.Command("tar", "-x", "-C", dir)
+
+	pipe, err := archive.StdoutPipe()
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	untar.Stdin = pipe
+
+	if err := untar.Start(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	if err := archive.Run(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	if err := untar.Wait(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	local := dir
+	if subdir != "" {
+		local = dir + string(os.PathSeparator) + subdir
+	}
+
+	return local, cleanup, nil
+}
+
+// splitGitRef splits "git://host/repo.git#ref:subdir" into its repo URI,
+// ref (defaulting to HEAD), and subdir (defaulting to "").
+func splitGitRef(ref string) (uri, gitRef, subdir string) {
+	uri = ref
+	gitRef = "HEAD"
+
+	i := strings.Index(ref, "#")
+	if i < 0 {
+		return uri, gitRef, subdir
+	}
+
+	uri = ref[:i]
+	frag := ref[i+1:]
+
+	if j := strings.Index(frag, ":"); j >= 0 {
+		gitRef = frag[:j]
+		subdir = frag[j+1:]
+	} else {
+		gitRef = frag
+	}
+
+	if gitRef == "" {
+		gitRef = "HEAD"
+	}
+
+	return uri, gitRef, subdir
+}
+
+// resolveTarballURL downloads url and extracts it as a (possibly gzipped)
+// tar archive into a temp directory.
+func resolveTarballURL(url string) (string, func(), error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", nil, fmt.Errorf("context fetch failed: %s: %s", url, resp.Status)
+	}
+
+	return resolveTar(resp.Body)
+}
@@ -0,0 +1,113 @@
+package context
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gzipMagic is the two leading bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// resolveTar extracts r, which may or may not be gzip-compressed, into a
+// fresh temp directory and returns it along with a cleanup function.
+func resolveTar(r io.Reader) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "convox-context-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if err := extractTar(r, dir); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return dir, cleanup, nil
+}
+
+// extractTar untars r into dir, transparently gunzipping it first if its
+// leading bytes are the gzip magic number.
+func extractTar(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	var tr *tar.Reader
+
+	if len(magic) == 2 && magic[0] == gzipMagic[0] && magic[1] == gzipMagic[1] {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		tr = tar.NewReader(gz)
+	} else {
+		tr = tar.NewReader(br)
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := sanitizeTarPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+
+			f.Close()
+		}
+	}
+}
+
+// sanitizeTarPath joins dir and name the way extractTar needs to, but
+// rejects any tar entry whose "../" segments would resolve outside dir - a
+// "zip slip" archive pulled from an untrusted remote build context could
+// otherwise write anywhere on disk. An absolute name is not rejected; it
+// is joined under dir like any other.
+func sanitizeTarPath(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("illegal tar path: %s", name)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,51 @@
+package context
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildTar(entries map[string]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	for name, body := range entries {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))})
+		tw.Write([]byte(body))
+	}
+
+	tw.Close()
+
+	return buf
+}
+
+func TestExtractTarRejectsEscape(t *testing.T) {
+	dir := t.TempDir()
+
+	buf := buildTar(map[string]string{"../../../tmp/convox-zip-slip-test": "pwned"})
+
+	if err := extractTar(buf, dir); err == nil {
+		t.Fatal("expected error extracting a path-escaping tar entry, got nil")
+	}
+
+	if _, err := os.Stat(filepath.Join(os.TempDir(), "convox-zip-slip-test")); err == nil {
+		t.Fatal("escaping entry was written outside the target dir")
+	}
+}
+
+func TestExtractTarAllowsNormalEntries(t *testing.T) {
+	dir := t.TempDir()
+
+	buf := buildTar(map[string]string{"a/b.txt": "hi"})
+
+	if err := extractTar(buf, dir); err != nil {
+		t.Fatalf("extractTar: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a", "b.txt")); err != nil {
+		t.Fatalf("expected file extracted: %s", err)
+	}
+}
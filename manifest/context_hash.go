@@ -0,0 +1,181 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ContextHash returns a deterministic digest over the Dockerfile at
+// dockerFile, the build context filtered through .dockerignore, and the
+// resolved set of --build-arg values. File contents and headers (mode,
+// size, path) are mixed in but mtimes are not, so the hash is stable
+// across fresh checkouts of the same source. Two builds with the same
+// ContextHash will produce the same image, which makes it suitable as a
+// remote build cache key.
+//
+// dockerFile must be the same path dockerBuild resolved and actually
+// passed to `docker build -f`: Build.Dockerfile only overrides the
+// legacy top-level Service.Dockerfile, so re-deriving it from b alone
+// would hash the wrong file for any service still using that field.
+func (b Build) ContextHash(dir, dockerFile string, args map[string]string) (string, error) {
+	context := filepath.Join(dir, coalesce(b.Context, "."))
+
+	h := sha256.New()
+
+	df, err := ioutil.ReadFile(dockerFile)
+	if err != nil {
+		return "", err
+	}
+	h.Write(df)
+
+	ignore, err := readDockerignore(filepath.Join(context, ".dockerignore"))
+	if err != nil {
+		return "", err
+	}
+
+	paths := []string{}
+
+	err = filepath.Walk(context, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == context {
+			return nil
+		}
+
+		rel, err := filepath.Rel(context, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if ignore.matches(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		paths = append(paths, rel)
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		if err := hashContextEntry(h, context, rel); err != nil {
+			return "", err
+		}
+	}
+
+	argNames := []string{}
+
+	for k := range args {
+		argNames = append(argNames, k)
+	}
+
+	sort.Strings(argNames)
+
+	for _, k := range argNames {
+		fmt.Fprintf(h, "arg %s=%s\n", k, args[k])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashContextEntry mixes one context file's header and content into h,
+// keyed by its path so that a renamed-but-identical file changes the
+// digest.
+func hashContextEntry(h io.Writer, context, rel string) error {
+	path := filepath.Join(context, rel)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h, "symlink path=%s mode=%o target=%s\n", rel, info.Mode().Perm(), target)
+
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(h, "file path=%s mode=%o size=%d sha256=%x\n", rel, info.Mode().Perm(), info.Size(), sum.Sum(nil))
+
+	return nil
+}
+
+// remoteCacheMarker returns the path of the marker file that records the
+// image built for a given ContextHash.
+func remoteCacheMarker(cacheDir, hash string) string {
+	return filepath.Join(cacheDir, hash+".image")
+}
+
+// remoteCacheHit looks for a marker left by a previous build with the
+// same ContextHash and, if `docker inspect` confirms the image it points
+// to still exists locally, returns its ID. No registry is queried or
+// pulled from.
+func remoteCacheHit(cacheDir, hash string) (string, bool) {
+	data, err := ioutil.ReadFile(remoteCacheMarker(cacheDir, hash))
+	if err != nil {
+		return "", false
+	}
+
+	id := strings.TrimSpace(string(data))
+	if id == "" {
+		return "", false
+	}
+
+	if _, err := DefaultRunner.CombinedOutput(Docker("inspect", id)); err != nil {
+		return "", false
+	}
+
+	return id, true
+}
+
+// writeRemoteCacheMarker records tag's image ID under hash so a later
+// build with an identical ContextHash can skip straight to a `docker tag`.
+func writeRemoteCacheMarker(cacheDir, hash, tag string) error {
+	out, err := DefaultRunner.CombinedOutput(Docker("inspect", "-f", "{{.Id}}", tag))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(remoteCacheMarker(cacheDir, hash), []byte(strings.TrimSpace(string(out))), 0644)
+}
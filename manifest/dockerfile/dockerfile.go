@@ -0,0 +1,362 @@
+// Package dockerfile parses Dockerfiles into an ordered, structured form so
+// that other subsystems (build arg collection, linting, cache hashing,
+// ONBUILD handling) can reason about stages and instructions instead of
+// re-scanning raw text.
+package dockerfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Instruction is a single parsed Dockerfile directive, e.g. `FROM`, `ARG`,
+// `COPY`. Continuation lines (trailing escape character) are joined into a
+// single Raw/Args before parsing, and comment-only lines are dropped
+// entirely rather than represented as instructions.
+type Instruction struct {
+	Cmd  string   // uppercased instruction name, e.g. "FROM", "ARG", "ONBUILD"
+	Args []string // whitespace-split arguments following Cmd
+	Raw  string   // the full instruction with continuations joined, comment stripped
+}
+
+// Arg is an ARG declaration, with its default value if one was given.
+type Arg struct {
+	Name       string
+	Default    string
+	HasDefault bool
+}
+
+// Stage is one `FROM` block of a (possibly multi-stage) Dockerfile.
+type Stage struct {
+	Index        int    // 0-based position among stages
+	Name         string // stage alias from `FROM ... AS <name>`, or "" if unnamed
+	From         string // the image or stage this stage is built from
+	Instructions []Instruction
+}
+
+// File is a fully parsed Dockerfile.
+type File struct {
+	Escape     byte  // continuation/escape character, '\\' unless overridden
+	GlobalArgs []Arg // ARG declarations that appear before the first FROM
+	Stages     []Stage
+}
+
+// ArgsDeclared returns the ARG names (with defaults) declared directly
+// within the stage, in the order they appear.
+func (s *Stage) ArgsDeclared() []Arg {
+	args := []Arg{}
+
+	for _, i := range s.Instructions {
+		if i.Cmd != "ARG" || len(i.Args) < 1 {
+			continue
+		}
+
+		args = append(args, parseArg(i.Args[0]))
+	}
+
+	return args
+}
+
+// OnBuild returns the ONBUILD trigger instructions declared in this stage,
+// with the leading "ONBUILD" stripped off each one's Cmd/Args.
+func (s *Stage) OnBuild() []Instruction {
+	triggers := []Instruction{}
+
+	for _, i := range s.Instructions {
+		if i.Cmd != "ONBUILD" || len(i.Args) < 1 {
+			continue
+		}
+
+		triggers = append(triggers, Instruction{
+			Cmd:  strings.ToUpper(i.Args[0]),
+			Args: i.Args[1:],
+			Raw:  i.Raw,
+		})
+	}
+
+	return triggers
+}
+
+// Stage looks up a stage by name (as given to `FROM ... AS <name>`) or by
+// numeric index, the way `docker build --target` or a multi-stage `COPY
+// --from=` reference would. It returns nil if no such stage exists.
+func (f *File) Stage(ref string) *Stage {
+	for i, s := range f.Stages {
+		if s.Name == ref {
+			return &f.Stages[i]
+		}
+	}
+
+	for i := range f.Stages {
+		if fmt.Sprintf("%d", i) == ref {
+			return &f.Stages[i]
+		}
+	}
+
+	return nil
+}
+
+// Target returns the stage that a plain `docker build` (no --target) would
+// produce, i.e. the last one.
+func (f *File) Target() *Stage {
+	if len(f.Stages) == 0 {
+		return nil
+	}
+
+	return &f.Stages[len(f.Stages)-1]
+}
+
+// TargetArgs resolves the ARGs that are actually in scope for the target
+// stage: its own declarations plus those of every stage it descends from
+// through `FROM <previous-stage>`, deduplicated by name with the
+// nearest-to-target declaration winning.
+func (f *File) TargetArgs() []Arg {
+	stage := f.Target()
+	if stage == nil {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	args := []Arg{}
+
+	for stage != nil {
+		for _, a := range stage.ArgsDeclared() {
+			if seen[a.Name] {
+				continue
+			}
+			seen[a.Name] = true
+			args = append(args, a)
+		}
+
+		stage = f.Stage(stage.From)
+	}
+
+	return args
+}
+
+// ParseInstructions parses a list of already-separated instruction
+// strings, such as the array returned by `docker inspect --format
+// '{{json .Config.OnBuild}}'`, into Instructions. Unlike Parse, it does
+// not join continuations or group the result into stages, since each
+// string is already a complete instruction on its own.
+func ParseInstructions(lines []string) []Instruction {
+	instructions := []Instruction{}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+
+		instructions = append(instructions, Instruction{
+			Cmd:  strings.ToUpper(fields[0]),
+			Args: fields[1:],
+			Raw:  line,
+		})
+	}
+
+	return instructions
+}
+
+// ParseFile reads and parses the Dockerfile at path.
+func ParseFile(path string) (*File, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return Parse(fd)
+}
+
+// Parse reads a Dockerfile from r, honoring a leading `# escape=` parser
+// directive, joining escaped line continuations, and stripping both
+// full-line and trailing comments before splitting the result into
+// stages.
+func Parse(r io.Reader) (*File, error) {
+	lines, escape, err := joinContinuations(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{Escape: escape}
+
+	var current *Stage
+
+	for _, raw := range lines {
+		line := stripTrailingComment(raw)
+
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+
+		cmd := strings.ToUpper(fields[0])
+		args := fields[1:]
+
+		instruction := Instruction{Cmd: cmd, Args: args, Raw: line}
+
+		if cmd == "FROM" {
+			imageArgs := args
+			for len(imageArgs) > 0 && strings.HasPrefix(imageArgs[0], "--") {
+				imageArgs = imageArgs[1:]
+			}
+
+			if len(imageArgs) < 1 {
+				return nil, fmt.Errorf("invalid FROM instruction: %q", line)
+			}
+
+			stage := Stage{
+				Index: len(f.Stages),
+				From:  imageArgs[0],
+			}
+
+			if len(imageArgs) >= 3 && strings.EqualFold(imageArgs[1], "AS") {
+				stage.Name = imageArgs[2]
+			}
+
+			f.Stages = append(f.Stages, stage)
+			current = &f.Stages[len(f.Stages)-1]
+			current.Instructions = append(current.Instructions, instruction)
+			continue
+		}
+
+		if current == nil {
+			// before the first FROM, only ARG (and comments, already
+			// stripped) are valid
+			if cmd == "ARG" && len(args) >= 1 {
+				f.GlobalArgs = append(f.GlobalArgs, parseArg(args[0]))
+			}
+			continue
+		}
+
+		current.Instructions = append(current.Instructions, instruction)
+	}
+
+	return f, nil
+}
+
+// joinContinuations scans r line by line, honoring a leading `# escape=`
+// directive (only valid before any other content), stripping full-line
+// comments, and joining lines that end in the escape character. It also
+// returns the escape character in effect.
+func joinContinuations(r io.Reader) ([]string, byte, error) {
+	escape := byte('\\')
+	directiveAllowed := true
+
+	lines := []string{}
+	pending := ""
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+
+		if trimmed == "" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "#") {
+			if directiveAllowed {
+				if e, ok := parseEscapeDirective(trimmed); ok {
+					escape = e
+					continue
+				}
+			}
+			// any other comment line is ignored, but once we've seen a
+			// non-directive comment or content, directives no longer apply
+			if !isEscapeDirective(trimmed) {
+				directiveAllowed = false
+			}
+			continue
+		}
+
+		directiveAllowed = false
+
+		if pending != "" {
+			pending += " " + text
+		} else {
+			pending = text
+		}
+
+		if strings.HasSuffix(strings.TrimRight(pending, " \t"), string(escape)) {
+			trimmedPending := strings.TrimRight(pending, " \t")
+			pending = strings.TrimSuffix(trimmedPending, string(escape))
+			continue
+		}
+
+		lines = append(lines, strings.TrimSpace(pending))
+		pending = ""
+	}
+
+	if strings.TrimSpace(pending) != "" {
+		lines = append(lines, strings.TrimSpace(pending))
+	}
+
+	return lines, escape, scanner.Err()
+}
+
+// stripTrailingComment removes an unquoted trailing `# ...` comment from
+// an instruction line, e.g. turning `RUN make build # why` into
+// `RUN make build`. A `#` inside single or double quotes is left alone.
+func stripTrailingComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#':
+			return strings.TrimSpace(line[:i])
+		}
+	}
+
+	return line
+}
+
+func isEscapeDirective(line string) bool {
+	_, ok := parseEscapeDirective(line)
+	return ok
+}
+
+// parseEscapeDirective recognizes a `# escape=\` or a backtick escape parser
+// directive line, case-insensitively, per the Dockerfile spec.
+func parseEscapeDirective(line string) (byte, bool) {
+	body := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+
+	parts := strings.SplitN(body, "=", 2)
+	if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), "escape") {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(parts[1])
+
+	switch value {
+	case "\\":
+		return '\\', true
+	case "`":
+		return '`', true
+	default:
+		return 0, false
+	}
+}
+
+func parseArg(raw string) Arg {
+	parts := strings.SplitN(raw, "=", 2)
+
+	if len(parts) == 2 {
+		return Arg{Name: parts[0], Default: parts[1], HasDefault: true}
+	}
+
+	return Arg{Name: parts[0]}
+}
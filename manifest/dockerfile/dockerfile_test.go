@@ -0,0 +1,55 @@
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStageOnBuildCopyRunAdd(t *testing.T) {
+	f, err := Parse(strings.NewReader(`FROM base
+ONBUILD COPY . /app
+ONBUILD RUN make build
+ONBUILD ADD assets.tar.gz /app/assets
+`))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	triggers := f.Target().OnBuild()
+	if len(triggers) != 3 {
+		t.Fatalf("expected 3 triggers, got %d: %+v", len(triggers), triggers)
+	}
+
+	want := []struct {
+		cmd  string
+		args []string
+	}{
+		{"COPY", []string{".", "/app"}},
+		{"RUN", []string{"make", "build"}},
+		{"ADD", []string{"assets.tar.gz", "/app/assets"}},
+	}
+
+	for i, w := range want {
+		if triggers[i].Cmd != w.cmd {
+			t.Errorf("trigger %d: got Cmd %q, want %q", i, triggers[i].Cmd, w.cmd)
+		}
+		if strings.Join(triggers[i].Args, " ") != strings.Join(w.args, " ") {
+			t.Errorf("trigger %d: got Args %v, want %v", i, triggers[i].Args, w.args)
+		}
+	}
+}
+
+func TestParseInstructionsOnBuild(t *testing.T) {
+	triggers := ParseInstructions([]string{
+		"COPY . /app",
+		"RUN make build",
+		"ADD assets.tar.gz /app/assets",
+	})
+
+	if len(triggers) != 3 {
+		t.Fatalf("expected 3 triggers, got %d", len(triggers))
+	}
+	if triggers[0].Cmd != "COPY" || triggers[1].Cmd != "RUN" || triggers[2].Cmd != "ADD" {
+		t.Fatalf("unexpected commands: %+v", triggers)
+	}
+}
@@ -0,0 +1,171 @@
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStagesAndArgs(t *testing.T) {
+	f, err := Parse(strings.NewReader(`ARG VERSION=1.0
+
+FROM golang:${VERSION} AS build
+ARG GIT_SHA
+ARG DEBUG=false
+RUN go build ./...
+
+FROM alpine
+COPY --from=build /app /app
+`))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	if got, want := len(f.GlobalArgs), 1; got != want {
+		t.Fatalf("GlobalArgs: got %d, want %d", got, want)
+	}
+	if f.GlobalArgs[0] != (Arg{Name: "VERSION", Default: "1.0", HasDefault: true}) {
+		t.Fatalf("GlobalArgs[0]: got %+v", f.GlobalArgs[0])
+	}
+
+	if got, want := len(f.Stages), 2; got != want {
+		t.Fatalf("Stages: got %d, want %d", got, want)
+	}
+
+	build := f.Stages[0]
+	if build.Name != "build" {
+		t.Errorf("Stages[0].Name: got %q, want %q", build.Name, "build")
+	}
+	if build.From != "golang:${VERSION}" {
+		t.Errorf("Stages[0].From: got %q", build.From)
+	}
+
+	args := build.ArgsDeclared()
+	if len(args) != 2 {
+		t.Fatalf("Stages[0].ArgsDeclared: got %d, want 2: %+v", len(args), args)
+	}
+	if args[0] != (Arg{Name: "GIT_SHA"}) {
+		t.Errorf("ArgsDeclared[0]: got %+v", args[0])
+	}
+	if args[1] != (Arg{Name: "DEBUG", Default: "false", HasDefault: true}) {
+		t.Errorf("ArgsDeclared[1]: got %+v", args[1])
+	}
+
+	target := f.Target()
+	if target.Name != "" || target.From != "alpine" {
+		t.Fatalf("Target(): got %+v", target)
+	}
+}
+
+func TestParseFromWithPlatformFlag(t *testing.T) {
+	f, err := Parse(strings.NewReader(`FROM --platform=linux/amd64 golang:1.21 AS build
+RUN go build ./...
+`))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	if got, want := len(f.Stages), 1; got != want {
+		t.Fatalf("Stages: got %d, want %d", got, want)
+	}
+
+	stage := f.Stages[0]
+	if stage.From != "golang:1.21" {
+		t.Errorf("From: got %q, want %q", stage.From, "golang:1.21")
+	}
+	if stage.Name != "build" {
+		t.Errorf("Name: got %q, want %q", stage.Name, "build")
+	}
+}
+
+func TestParseFromMissingImageErrors(t *testing.T) {
+	if _, err := Parse(strings.NewReader("FROM\n")); err == nil {
+		t.Fatal("expected an error parsing a FROM with no image, got nil")
+	}
+
+	if _, err := Parse(strings.NewReader("FROM --platform=linux/amd64\n")); err == nil {
+		t.Fatal("expected an error parsing a FROM with only flags, got nil")
+	}
+}
+
+func TestParseStripsTrailingComments(t *testing.T) {
+	f, err := Parse(strings.NewReader(`FROM base
+ONBUILD RUN make build # why
+RUN echo "kept # not a comment"
+`))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	instrs := f.Target().Instructions
+
+	onbuild := instrs[1]
+	if onbuild.Raw != "ONBUILD RUN make build" {
+		t.Errorf("Raw: got %q", onbuild.Raw)
+	}
+	if strings.Join(onbuild.Args, " ") != "RUN make build" {
+		t.Errorf("Args: got %v", onbuild.Args)
+	}
+
+	run := instrs[2]
+	if !strings.Contains(run.Raw, `"kept # not a comment"`) {
+		t.Errorf("quoted # should survive: got %q", run.Raw)
+	}
+}
+
+func TestJoinContinuations(t *testing.T) {
+	f, err := Parse(strings.NewReader("FROM busybox\nCOPY package.json\\\npackage-lock.json ./\n"))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	copyInstr := f.Target().Instructions[1]
+	if strings.Join(copyInstr.Args, " ") != "package.json package-lock.json ./" {
+		t.Fatalf("continuation joined wrong: got %v", copyInstr.Args)
+	}
+}
+
+func TestParseEscapeDirectiveChangesContinuationChar(t *testing.T) {
+	f, err := Parse(strings.NewReader("# escape=`\nFROM busybox\nRUN echo a `\necho b\n"))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	run := f.Target().Instructions[1]
+	if strings.Join(run.Args, " ") != "echo a echo b" {
+		t.Fatalf("backtick continuation not honored: got %v", run.Args)
+	}
+}
+
+func TestTargetArgsPrecedence(t *testing.T) {
+	f, err := Parse(strings.NewReader(`FROM scratch AS base
+ARG SHARED=base-value
+ARG BASE_ONLY=base-only
+
+FROM base AS build
+ARG SHARED=build-value
+ARG BUILD_ONLY=build-only
+`))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	args := f.TargetArgs()
+
+	byName := map[string]Arg{}
+	for _, a := range args {
+		byName[a.Name] = a
+	}
+
+	if got := byName["SHARED"].Default; got != "build-value" {
+		t.Errorf("SHARED should resolve to the nearest-to-target declaration, got %q", got)
+	}
+	if _, ok := byName["BASE_ONLY"]; !ok {
+		t.Error("expected BASE_ONLY inherited from the base stage")
+	}
+	if _, ok := byName["BUILD_ONLY"]; !ok {
+		t.Error("expected BUILD_ONLY declared on the target stage")
+	}
+	if len(args) != 3 {
+		t.Fatalf("expected 3 deduplicated args, got %d: %+v", len(args), args)
+	}
+}
@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreRule is a single line from a .dockerignore file.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+}
+
+type ignoreRules []ignoreRule
+
+// readDockerignore loads the exclude patterns from file. A missing file
+// means no patterns are excluded, matching Docker's own behavior.
+func readDockerignore(file string) (ignoreRules, error) {
+	rules := ignoreRules{}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		negate := false
+		if strings.HasPrefix(line, "!") {
+			negate = true
+			line = line[1:]
+		}
+
+		rules = append(rules, ignoreRule{pattern: strings.TrimSuffix(line, "/"), negate: negate})
+	}
+
+	return rules, scanner.Err()
+}
+
+// matches reports whether rel (a slash-separated path relative to the
+// build context root) is excluded. Rules apply in file order so that a
+// later `!pattern` can re-include a path an earlier rule excluded.
+func (rules ignoreRules) matches(rel string) bool {
+	excluded := false
+
+	for _, r := range rules {
+		if matchesIgnorePattern(r.pattern, rel) {
+			excluded = !r.negate
+		}
+	}
+
+	return excluded
+}
+
+// matchesIgnorePattern reports whether pattern matches rel, or matches a
+// parent directory of rel (so excluding a directory excludes everything
+// under it), with minimal "**" support for matching any number of path
+// segments.
+func matchesIgnorePattern(pattern, rel string) bool {
+	if ok, _ := path.Match(pattern, rel); ok {
+		return true
+	}
+
+	if strings.Contains(pattern, "**") {
+		parts := strings.SplitN(pattern, "**", 2)
+		prefix := strings.TrimSuffix(parts[0], "/")
+		suffix := strings.TrimPrefix(parts[1], "/")
+
+		if prefix != "" && !strings.HasPrefix(rel, prefix) {
+			return false
+		}
+		if suffix == "" {
+			return true
+		}
+
+		if ok, _ := path.Match(suffix, path.Base(rel)); ok {
+			return true
+		}
+
+		return strings.HasSuffix(rel, suffix)
+	}
+
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if ok, _ := path.Match(pattern, dir); ok {
+			return true
+		}
+	}
+
+	return false
+}
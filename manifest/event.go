@@ -0,0 +1,163 @@
+package manifest
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Event kinds, modeled after Docker's own jsonmessage stream.
+const (
+	EventBuild = "build"
+	EventPull  = "pull"
+	EventTag   = "tag"
+	EventCache = "cache"
+	EventError = "error"
+)
+
+// Event is a single structured progress update from a Build. Unlike the
+// raw string Stream, it lets a UI render progress bars, distinguish pull
+// layers, and classify errors without scraping docker CLI output.
+type Event struct {
+	Service  string         // the manifest service this event is for, or the image reference for pull and pull-tag events
+	Kind     string         // EventBuild, EventPull, EventTag, EventCache, or EventError
+	Status   string         // short human status, e.g. "Downloading", "Step 3/8"
+	ID       string         // layer ID for pull events, step number for build events
+	Progress *EventProgress // byte progress, if the line carried any
+	Stream   string         // the raw log line this event was parsed from, if any
+}
+
+// EventProgress is the current/total byte progress of a pull layer.
+type EventProgress struct {
+	Current int64
+	Total   int64
+}
+
+var (
+	stepEventRE  = regexp.MustCompile(`^Step (\d+)/(\d+)\s*:\s*(.*)$`)
+	layerEventRE = regexp.MustCompile(`^([0-9a-f]{12}):\s*(.+?)(?:\s+\[[=>\s]*\]\s+([0-9.]+\s?\w*)\s*/\s*([0-9.]+\s?\w*))?$`)
+)
+
+// parseEvent classifies a single raw docker CLI line into an Event, or
+// returns nil if the line doesn't match a known shape.
+func parseEvent(service, line string) *Event {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	if m := stepEventRE.FindStringSubmatch(line); m != nil {
+		return &Event{
+			Service: service,
+			Kind:    EventBuild,
+			Status:  fmt.Sprintf("Step %s/%s", m[1], m[2]),
+			ID:      m[1],
+			Stream:  line,
+		}
+	}
+
+	if m := layerEventRE.FindStringSubmatch(line); m != nil {
+		e := &Event{
+			Service: service,
+			Kind:    EventPull,
+			Status:  m[2],
+			ID:      m[1],
+			Stream:  line,
+		}
+
+		if cur, ok := parseByteSize(m[3]); ok {
+			if total, ok := parseByteSize(m[4]); ok {
+				e.Progress = &EventProgress{Current: cur, Total: total}
+			}
+		}
+
+		return e
+	}
+
+	if strings.Contains(strings.ToLower(line), "error") {
+		return &Event{Service: service, Kind: EventError, Status: line, Stream: line}
+	}
+
+	return nil
+}
+
+var byteSizeRE = regexp.MustCompile(`^([0-9.]+)\s*([a-zA-Z]*)$`)
+
+var byteSizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"kb": 1000,
+	"mb": 1000 * 1000,
+	"gb": 1000 * 1000 * 1000,
+}
+
+// parseByteSize parses a docker progress size like "1.82kB" into bytes.
+func parseByteSize(s string) (int64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+
+	m := byteSizeRE.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+
+	unit, ok := byteSizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(value * float64(unit)), true
+}
+
+// emitEvent sends e to events if the caller configured one via
+// BuildOptions.Events; it is a no-op otherwise.
+func emitEvent(events chan Event, e Event) {
+	if events == nil {
+		return
+	}
+
+	events <- e
+}
+
+// RenderEvents returns an Event channel whose events are rendered to w in
+// the same terminal-style format the raw Stream has always produced. It
+// lets a caller that only wants to consume structured Events keep the
+// familiar CLI output for free.
+func RenderEvents(w io.Writer) chan Event {
+	events := make(chan Event)
+
+	go func() {
+		for e := range events {
+			if e.Stream != "" {
+				fmt.Fprintf(w, "%s\n", e.Stream)
+				continue
+			}
+
+			switch e.Kind {
+			case EventError:
+				fmt.Fprintf(w, "error: %s\n", e.Status)
+			case EventPull:
+				if e.Progress != nil {
+					fmt.Fprintf(w, "%s: %s %d/%d\n", e.ID, e.Status, e.Progress.Current, e.Progress.Total)
+				} else {
+					fmt.Fprintf(w, "%s: %s\n", e.ID, e.Status)
+				}
+			case EventBuild, EventTag, EventCache:
+				fmt.Fprintf(w, "%s\n", coalesce(e.Stream, e.Status))
+			default:
+				fmt.Fprintf(w, "%s\n", coalesce(e.Stream, e.Status))
+			}
+		}
+	}()
+
+	return events
+}
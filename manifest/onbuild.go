@@ -0,0 +1,41 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/reverbdotcom/rack/manifest/dockerfile"
+)
+
+// onBuildLabel is the image label a built service's own ONBUILD triggers
+// are recorded under, so that another service in the same manifest which
+// builds FROM this one's tag can look them up with a single `docker
+// inspect` rather than re-parsing Dockerfiles across services.
+const onBuildLabel = "com.convox.onbuild"
+
+// baseImageOnBuild returns the ONBUILD triggers configured on image,
+// pulling it first if it isn't already present locally. The Docker daemon
+// already applies these triggers on its own whenever it builds FROM image,
+// so callers must only use the result for recording/diagnostics, never for
+// re-inserting the triggers into a Dockerfile that's actually built -
+// doing so would run each trigger a second time.
+func baseImageOnBuild(s Stream, image string, verbose bool) ([]dockerfile.Instruction, error) {
+	if _, err := DefaultRunner.CombinedOutput(Docker("inspect", image)); err != nil {
+		if err := DefaultRunner.Run(s, Docker("pull", image), RunnerOptions{Verbose: verbose}); err != nil {
+			return nil, fmt.Errorf("build error: %s", err)
+		}
+	}
+
+	out, err := DefaultRunner.CombinedOutput(Docker("inspect", "--format", "{{json .Config.OnBuild}}", image))
+	if err != nil {
+		return nil, err
+	}
+
+	triggers := []string{}
+
+	if err := json.Unmarshal(out, &triggers); err != nil {
+		return nil, err
+	}
+
+	return dockerfile.ParseInstructions(triggers), nil
+}